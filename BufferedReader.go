@@ -1,17 +1,23 @@
-/*Package breader (Buffered File Reader), asynchronous parsing and pre-processing while
- reading file. Safe cancellation is also supported.
+/*
+Package breader (Buffered File Reader), asynchronous parsing and pre-processing while
 
-Detail: https://github.com/shenwei356/breader
+	reading file. Safe cancellation is also supported.
 
+Detail: https://github.com/shenwei356/breader
 */
 package breader
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/brentp/xopen"
 	"github.com/cznic/sortutil"
@@ -28,6 +34,7 @@ type Chunk struct {
 type linesChunk struct {
 	ID   uint64 // useful for keeping the order of chunk in downstream process
 	Data []string
+	Err  error // set when ctx is canceled before the worker pool sees this chunk
 }
 
 // BufferedReader is BufferedReader
@@ -37,10 +44,38 @@ type BufferedReader struct {
 	ChunkSize   int
 	ProcessFunc func(string) (interface{}, bool, error)
 
+	ProcessBytesFunc func([]byte) (interface{}, bool, error) // zero-allocation alternative to ProcessFunc, mutually exclusive with it
+	Splitter         RecordSplitter                          // frames records for ProcessBytesFunc; nil means newline-delimited
+
 	Ch        chan Chunk
 	done      chan struct{}
-	finished  bool
-	cancelled bool
+	finished  int32 // accessed via sync/atomic; read and written from multiple goroutines
+	cancelled int32 // accessed via sync/atomic; read and written from multiple goroutines
+
+	ctx context.Context // watched by the producer alongside done; defaults to context.Background()
+
+	tee *spillTee // non-nil for readers created with NewRewindableBufferedReader
+
+	byteLimiter   *tokenBucket // throttles bytes read from the underlying file
+	recordLimiter *tokenBucket // throttles records delivered on Ch
+}
+
+// throttleRecords blocks, if a record rate limit is configured, until
+// enough tokens are available to deliver chunk's records.
+func (reader *BufferedReader) throttleRecords(chunk Chunk) {
+	if n := len(chunk.Data); n > 0 {
+		reader.recordLimiter.take(int64(n), reader.done)
+	}
+}
+
+func (reader *BufferedReader) isFinished() bool {
+	return atomic.LoadInt32(&reader.finished) != 0
+}
+
+// setFinished marks the reader as finished and reports whether this call
+// was the one that did so.
+func (reader *BufferedReader) setFinished() bool {
+	return atomic.CompareAndSwapInt32(&reader.finished, 0, 1)
 }
 
 // NewDefaultBufferedReader creates BufferedReader with default parameter
@@ -63,6 +98,37 @@ func NewBufferedReader(file string, bufferSize int, chunkSize int, fn func(line
 	return reader, nil
 }
 
+// NewBytesBufferedReader is like NewBufferedReader but fn receives each
+// record as a []byte slice into the reader's internal buffer rather than an
+// allocated string, avoiding the per-line string conversion that dominates
+// CPU when parsing large gzip'd files. The slice is only valid until fn
+// returns; copy it if it needs to outlive the call.
+func NewBytesBufferedReader(file string, bufferSize int, chunkSize int, fn func(line []byte) (interface{}, bool, error)) (*BufferedReader, error) {
+	reader, err := initBufferedReader(file, bufferSize, chunkSize, nil)
+	if err != nil {
+		return reader, err
+	}
+	reader.ProcessBytesFunc = fn
+	reader.run()
+	return reader, nil
+}
+
+// NewSplitBufferedReader is like NewBytesBufferedReader, but records are
+// framed by splitter instead of by '\n', so fn can receive whole multi-line
+// records (FASTA entries, MIME parts, log stanzas) that don't fit the
+// one-line-per-record model. See NewRollingHashSplitter for a
+// content-defined splitter.
+func NewSplitBufferedReader(file string, bufferSize int, chunkSize int, splitter RecordSplitter, fn func(record []byte) (interface{}, bool, error)) (*BufferedReader, error) {
+	reader, err := initBufferedReader(file, bufferSize, chunkSize, nil)
+	if err != nil {
+		return reader, err
+	}
+	reader.ProcessBytesFunc = fn
+	reader.Splitter = splitter
+	reader.run()
+	return reader, nil
+}
+
 // DefaultFunc just trim the new line symbol
 var DefaultFunc = func(line string) (interface{}, bool, error) {
 	line = strings.TrimRight(line, "\r\n")
@@ -70,6 +136,20 @@ var DefaultFunc = func(line string) (interface{}, bool, error) {
 }
 
 func initBufferedReader(file string, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error)) (*BufferedReader, error) {
+	fh, err := xopen.Ropen(file)
+	if err != nil {
+		return nil, err
+	}
+	return initBufferedReaderFromXopen(fh, bufferSize, chunkSize, fn), nil
+}
+
+// initBufferedReaderFromReader is the io.Reader-source counterpart of
+// initBufferedReader, used by NewBufferedReaderFromReader.
+func initBufferedReaderFromReader(r io.Reader, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error)) *BufferedReader {
+	return initBufferedReaderFromXopen(xopen.Buf(r), bufferSize, chunkSize, fn)
+}
+
+func initBufferedReaderFromXopen(fh *xopen.Reader, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error)) *BufferedReader {
 	if bufferSize < 1 {
 		bufferSize = 1
 	}
@@ -78,10 +158,6 @@ func initBufferedReader(file string, bufferSize int, chunkSize int, fn func(line
 	}
 
 	reader := new(BufferedReader)
-	fh, err := xopen.Ropen(file)
-	if err != nil {
-		return nil, err
-	}
 	reader.reader = fh
 
 	reader.BufferSize = bufferSize
@@ -89,10 +165,20 @@ func initBufferedReader(file string, bufferSize int, chunkSize int, fn func(line
 	reader.ProcessFunc = fn
 	reader.Ch = make(chan Chunk, bufferSize)
 	reader.done = make(chan struct{})
+	reader.ctx = context.Background()
 
-	reader.finished = false
-	reader.cancelled = false
-	return reader, nil
+	atomic.StoreInt32(&reader.finished, 0)
+	atomic.StoreInt32(&reader.cancelled, 0)
+
+	reader.byteLimiter = newTokenBucket()
+	reader.recordLimiter = newTokenBucket()
+	fh.Reader = bufio.NewReader(&rateLimitedReader{
+		src:     fh.Reader,
+		limiter: reader.byteLimiter,
+		done:    reader.done,
+	})
+
+	return reader
 }
 
 // ErrorCanceled means that the reading process is canceled
@@ -113,11 +199,13 @@ func (reader *BufferedReader) run() {
 				return
 			}
 			if chunk.ID == id {
+				reader.throttleRecords(chunk)
 				reader.Ch <- chunk
 				id++
 			} else { // check bufferd result
 				for true {
 					if chunk1, ok := chunks[id]; ok {
+						reader.throttleRecords(chunk1)
 						reader.Ch <- chunk1
 						delete(chunks, chunk1.ID)
 						id++
@@ -138,18 +226,43 @@ func (reader *BufferedReader) run() {
 			sort.Sort(ids)
 			for _, id := range ids {
 				chunk := chunks[id]
+				reader.throttleRecords(chunk)
 				reader.Ch <- chunk
 			}
 		}
 		close(reader.Ch)
 	}()
 
+	if reader.ProcessBytesFunc != nil {
+		reader.runBytes(ch2)
+		return
+	}
+
 	// receive lines and process with ProcessFunc
 	ch := make(chan linesChunk, reader.BufferSize)
 	go func() {
 		var wg sync.WaitGroup
 		tokens := make(chan int, reader.BufferSize)
+
+		// sendMu serializes every send on ch2 against the error path
+		// closing it, so a worker that is still processing its own
+		// chunk can never send on ch2 after another worker's error (or
+		// a canceled ctx) has already closed it.
+		var sendMu sync.Mutex
 		var hasErr bool
+		send := func(chunk Chunk, stop bool) {
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if hasErr {
+				return
+			}
+			ch2 <- chunk
+			if stop {
+				hasErr = true
+				close(ch2)
+			}
+		}
+
 		for chunk := range ch {
 			tokens <- 1
 			wg.Add(1)
@@ -160,28 +273,32 @@ func (reader *BufferedReader) run() {
 					<-tokens
 				}()
 
+				if chunk.Err != nil {
+					send(Chunk{chunk.ID, nil, chunk.Err}, true)
+					return
+				}
+
 				var chunkData []interface{}
 				for _, line := range chunk.Data {
 					result, ok, err := reader.ProcessFunc(line)
 					if err != nil {
-						ch2 <- Chunk{chunk.ID, chunkData, err}
-						close(ch2)
-						hasErr = true
+						send(Chunk{chunk.ID, chunkData, err}, true)
 						return
 					}
 					if ok {
 						chunkData = append(chunkData, result)
 					}
 				}
-				if !hasErr {
-					ch2 <- Chunk{chunk.ID, chunkData, nil}
-				}
+				send(Chunk{chunk.ID, chunkData, nil}, false)
 			}(chunk)
 		}
 		wg.Wait()
+
+		sendMu.Lock()
 		if !hasErr {
 			close(ch2)
 		}
+		sendMu.Unlock()
 	}()
 
 	// read lines
@@ -196,21 +313,27 @@ func (reader *BufferedReader) run() {
 		for {
 			select {
 			case <-reader.done:
-				if !reader.finished {
-					reader.finished = true
+				if reader.setFinished() {
 					reader.reader.Close()
 					close(ch)
 					return
 				}
+			case <-reader.ctx.Done():
+				if reader.setFinished() {
+					reader.reader.Close()
+					ch <- linesChunk{id, nil, reader.ctx.Err()}
+					close(ch)
+					return
+				}
 			default:
 			}
 			line, err = reader.reader.ReadString('\n')
 			if err != nil {
 				chunkData[i] = line
 				i++
-				ch <- linesChunk{id, chunkData[0:i]}
+				ch <- linesChunk{id, chunkData[0:i], nil}
 
-				reader.finished = true
+				reader.setFinished()
 				reader.reader.Close()
 				close(ch)
 				return
@@ -218,7 +341,7 @@ func (reader *BufferedReader) run() {
 			chunkData[i] = line
 			i++
 			if i == reader.ChunkSize {
-				ch <- linesChunk{id, chunkData[0:i]}
+				ch <- linesChunk{id, chunkData[0:i], nil}
 				id++
 				chunkData = make([]string, reader.ChunkSize)
 				i = 0
@@ -227,10 +350,159 @@ func (reader *BufferedReader) run() {
 	}()
 }
 
+// runBytes is the ProcessBytesFunc counterpart of run's line-reading and
+// processing goroutines. Because the scanner's line slices are only valid
+// until the next scan, ProcessBytesFunc must be called synchronously as
+// each record is scanned rather than handed off to a worker pool, so
+// reading and processing happen in a single goroutine here.
+func (reader *BufferedReader) runBytes(ch2 chan Chunk) {
+	go func() {
+		var (
+			i   int
+			id  uint64
+			err error
+		)
+
+		// nextRecord yields successive records: by '\n' when no Splitter
+		// is set, or by reader.Splitter's boundaries otherwise. Either
+		// way, the returned slice is only valid until the next call.
+		var nextRecord func() ([]byte, error)
+		if reader.Splitter != nil {
+			scanner := bufio.NewScanner(reader.reader)
+			scanner.Buffer(make([]byte, 0, defaultScanBufSize), maxRecordSize)
+			scanner.Split(bufio.SplitFunc(reader.Splitter))
+			nextRecord = func() ([]byte, error) {
+				if scanner.Scan() {
+					return scanner.Bytes(), nil
+				}
+				if err := scanner.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+		} else {
+			scanner := newLineScanner(reader.reader)
+			nextRecord = scanner.next
+		}
+
+		chunkData := make([]interface{}, 0, reader.ChunkSize)
+		for {
+			select {
+			case <-reader.done:
+				if reader.setFinished() {
+					reader.reader.Close()
+					ch2 <- Chunk{id, chunkData, nil}
+					close(ch2)
+					return
+				}
+			case <-reader.ctx.Done():
+				if reader.setFinished() {
+					reader.reader.Close()
+					ch2 <- Chunk{id, chunkData, reader.ctx.Err()}
+					close(ch2)
+					return
+				}
+			default:
+			}
+
+			var record []byte
+			record, err = nextRecord()
+			if len(record) > 0 {
+				result, ok, perr := reader.ProcessBytesFunc(record)
+				if perr != nil {
+					reader.setFinished()
+					reader.reader.Close()
+					ch2 <- Chunk{id, chunkData, perr}
+					close(ch2)
+					return
+				}
+				if ok {
+					chunkData = append(chunkData, result)
+				}
+				i++
+			}
+			if err != nil {
+				ch2 <- Chunk{id, chunkData, nil}
+
+				reader.setFinished()
+				reader.reader.Close()
+				close(ch2)
+				return
+			}
+			if i == reader.ChunkSize {
+				ch2 <- Chunk{id, chunkData, nil}
+				id++
+				chunkData = make([]interface{}, 0, reader.ChunkSize)
+				i = 0
+			}
+		}
+	}()
+}
+
+// defaultScanBufSize is the size of the read buffer lineScanner fills from
+// the underlying reader on each refill.
+const defaultScanBufSize = 64 * 1024
+
+// maxRecordSize bounds how large a single record's bufio.Scanner buffer may
+// grow when reader.Splitter is set, guarding against an unbounded read if a
+// Splitter never reports a boundary.
+const maxRecordSize = 64 * 1024 * 1024
+
+// lineScanner splits a stream into '\n'-terminated lines without the
+// per-line allocation that bufio.Reader.ReadString incurs: it reads into a
+// fixed-size buffer and hands out subslices of it, only copying bytes into
+// scratch when a line straddles a buffer boundary.
+type lineScanner struct {
+	r       io.Reader
+	buf     []byte
+	start   int // start of unconsumed data in buf
+	end     int // end of valid data in buf
+	scratch []byte
+	err     error
+}
+
+func newLineScanner(r io.Reader) *lineScanner {
+	return &lineScanner{r: r, buf: make([]byte, defaultScanBufSize)}
+}
+
+// next returns the next line, including its trailing '\n' if present. The
+// returned slice is only valid until the next call to next.
+func (s *lineScanner) next() ([]byte, error) {
+	for {
+		if s.start < s.end {
+			if i := bytes.IndexByte(s.buf[s.start:s.end], '\n'); i >= 0 {
+				line := s.buf[s.start : s.start+i+1]
+				s.start += i + 1
+				if len(s.scratch) > 0 {
+					line = append(s.scratch, line...)
+					s.scratch = s.scratch[:0]
+				}
+				return line, nil
+			}
+			s.scratch = append(s.scratch, s.buf[s.start:s.end]...)
+			s.start, s.end = 0, 0
+		}
+		if s.err != nil {
+			if len(s.scratch) > 0 {
+				line := s.scratch
+				s.scratch = nil
+				return line, s.err
+			}
+			return nil, s.err
+		}
+
+		var n int
+		n, s.err = s.r.Read(s.buf)
+		s.start, s.end = 0, n
+	}
+}
+
 // Cancel method cancel the reading process
 func (reader *BufferedReader) Cancel() {
-	if !reader.finished && !reader.cancelled {
+	if reader.isFinished() {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&reader.cancelled, 0, 1) {
 		close(reader.done)
-		reader.cancelled = true
 	}
 }
@@ -0,0 +1,30 @@
+package breader
+
+import (
+	"context"
+	"io"
+)
+
+// NewBufferedReaderFromReader is like NewBufferedReader, but reads from an
+// already-open r (a network connection, os.Stdin, a bytes.Buffer, an
+// io.Pipe from an upstream decoder) instead of opening a file. Canceling
+// ctx stops the read the same way Cancel does, and the final Chunk sent
+// carries ctx.Err() so a `range reader.Ch` loop observes why it stopped.
+func NewBufferedReaderFromReader(ctx context.Context, r io.Reader, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error)) (*BufferedReader, error) {
+	reader := initBufferedReaderFromReader(r, bufferSize, chunkSize, fn)
+	reader.ctx = ctx
+	reader.run()
+	return reader, nil
+}
+
+// NewBufferedReaderContext is like NewBufferedReader, but also stops the
+// read when ctx is canceled, delivering ctx.Err() on the final Chunk.
+func NewBufferedReaderContext(ctx context.Context, file string, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error)) (*BufferedReader, error) {
+	reader, err := initBufferedReader(file, bufferSize, chunkSize, fn)
+	if err != nil {
+		return reader, err
+	}
+	reader.ctx = ctx
+	reader.run()
+	return reader, nil
+}
@@ -0,0 +1,170 @@
+package breader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// NewRewindableBufferedReader is like NewBufferedReader, but the returned
+// BufferedReader's Rewind method can replay the stream from the beginning,
+// using spillDir/memLimit to mirror what has been read so far. Call Close
+// when done to remove any spill file.
+func NewRewindableBufferedReader(file string, bufferSize int, chunkSize int, fn func(line string) (interface{}, bool, error), spillDir string, memLimit int64) (*BufferedReader, error) {
+	reader, err := initBufferedReader(file, bufferSize, chunkSize, fn)
+	if err != nil {
+		return reader, err
+	}
+
+	reader.tee = newSpillTee(reader.reader.Reader, spillDir, memLimit)
+	reader.reader.Reader = bufio.NewReader(reader.tee)
+
+	reader.run()
+	return reader, nil
+}
+
+// Rewind restarts reading from the beginning of the stream, delivering
+// chunks on a new Ch. It only works on a BufferedReader created with
+// NewRewindableBufferedReader. Chunks of the current pass that have not
+// been consumed yet are drained and discarded first, so that pass reads
+// through to the end of the stream and the tee mirrors all of it. The tee
+// can only mirror what was actually read, so Rewind returns an error
+// instead of silently replaying a truncated stream if the reader was
+// Cancel()ed first.
+func (reader *BufferedReader) Rewind() error {
+	if reader.tee == nil {
+		return errors.New("breader: Rewind requires a reader created with NewRewindableBufferedReader")
+	}
+	if atomic.LoadInt32(&reader.cancelled) != 0 {
+		return errors.New("breader: Rewind cannot replay a stream that was Cancel()ed before reaching EOF")
+	}
+
+	for range reader.Ch {
+	}
+
+	replay, err := reader.tee.rewind()
+	if err != nil {
+		return err
+	}
+
+	reader.Ch = make(chan Chunk, reader.BufferSize)
+	reader.done = make(chan struct{})
+	atomic.StoreInt32(&reader.finished, 0)
+	atomic.StoreInt32(&reader.cancelled, 0)
+
+	reader.reader.Reader = bufio.NewReader(&rateLimitedReader{
+		src:     replay,
+		limiter: reader.byteLimiter,
+		done:    reader.done,
+	})
+
+	reader.run()
+	return nil
+}
+
+// Close releases resources held for rewinding, including any spill file
+// created on disk. It is a no-op for readers not created with
+// NewRewindableBufferedReader.
+func (reader *BufferedReader) Close() error {
+	if reader.tee == nil {
+		return nil
+	}
+	return reader.tee.close()
+}
+
+// spillTee mirrors every byte read from src so that it can be replayed from
+// the beginning later. Up to memLimit bytes are kept in memory; once that
+// is exceeded, the remaining bytes are spilled to a temporary file under
+// spillDir, so memory use is bounded regardless of stream length.
+type spillTee struct {
+	src      io.Reader
+	spillDir string
+	memLimit int64
+
+	memBuf  []byte
+	spillF  *os.File
+	spilled bool
+	replayF *os.File // read handle opened by the last rewind, closed by the next one
+}
+
+func newSpillTee(src io.Reader, spillDir string, memLimit int64) *spillTee {
+	if memLimit < 0 {
+		memLimit = 0
+	}
+	return &spillTee{src: src, spillDir: spillDir, memLimit: memLimit}
+}
+
+func (t *spillTee) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	if n > 0 {
+		if werr := t.mirror(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (t *spillTee) mirror(b []byte) error {
+	if !t.spilled {
+		if room := t.memLimit - int64(len(t.memBuf)); room > 0 {
+			take := room
+			if take > int64(len(b)) {
+				take = int64(len(b))
+			}
+			t.memBuf = append(t.memBuf, b[:take]...)
+			b = b[take:]
+		}
+		if len(b) == 0 {
+			return nil
+		}
+		f, err := ioutil.TempFile(t.spillDir, "breader-spill-")
+		if err != nil {
+			return err
+		}
+		t.spillF = f
+		t.spilled = true
+	}
+	_, err := t.spillF.Write(b)
+	return err
+}
+
+// rewind returns a fresh reader over everything mirrored so far, starting
+// from position zero. It closes the read handle opened by the previous
+// call, if any.
+func (t *spillTee) rewind() (io.Reader, error) {
+	if t.replayF != nil {
+		t.replayF.Close()
+		t.replayF = nil
+	}
+	if !t.spilled {
+		return bytes.NewReader(t.memBuf), nil
+	}
+	if err := t.spillF.Sync(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(t.spillF.Name())
+	if err != nil {
+		return nil, err
+	}
+	t.replayF = f
+	return io.MultiReader(bytes.NewReader(t.memBuf), f), nil
+}
+
+// close removes the spill file, if one was created, and closes the read
+// handle opened by the last rewind, if any.
+func (t *spillTee) close() error {
+	if t.replayF != nil {
+		t.replayF.Close()
+		t.replayF = nil
+	}
+	if t.spillF == nil {
+		return nil
+	}
+	name := t.spillF.Name()
+	t.spillF.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,75 @@
+package breader
+
+// RecordSplitter frames successive records out of a byte stream for
+// NewSplitBufferedReader. It shares bufio.SplitFunc's contract: given the
+// unconsumed input and whether more data may still arrive, it returns how
+// many bytes to advance past, the record found (nil if none is ready yet),
+// and an error. Returning advance == 0, record == nil, err == nil asks for
+// more input to be read before scanning again.
+type RecordSplitter func(data []byte, atEOF bool) (advance int, record []byte, err error)
+
+// rollingWindowSize is the width, in bytes, of the sliding window
+// NewRollingHashSplitter hashes to decide on a boundary.
+const rollingWindowSize = 64
+
+// rollingBase is the multiplier of the rolling polynomial hash.
+const rollingBase uint64 = 31
+
+// NewRollingHashSplitter returns a RecordSplitter that cuts the stream at
+// content-defined boundaries: it maintains a rolling checksum over a
+// sliding rollingWindowSize-byte window and declares a boundary once
+// (hash & mask) == mask. mask controls the average chunk size (e.g.
+// 1<<16 - 1 for roughly 64 KiB); minSize and maxSize additionally bound
+// every chunk regardless of the hash, except that the last chunk, emitted
+// at end of input, may be shorter than minSize. Because boundaries depend only on
+// content, not on read or buffer boundaries, they land on the same byte
+// offsets however the stream happens to be read.
+func NewRollingHashSplitter(mask uint64, minSize, maxSize int) RecordSplitter {
+	// charOut[b] removes the contribution of a byte leaving the window as
+	// the hash rolls forward, i.e. b * rollingBase^(rollingWindowSize-1).
+	var charOut [256]uint64
+	var pow uint64 = 1
+	for i := 0; i < rollingWindowSize-1; i++ {
+		pow *= rollingBase
+	}
+	for b := 0; b < 256; b++ {
+		charOut[b] = uint64(b) * pow
+	}
+
+	var (
+		window   [rollingWindowSize]byte
+		wpos     int
+		wlen     int
+		hash     uint64
+		scanned  int
+		chunkLen int
+	)
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		for ; scanned < len(data); scanned++ {
+			b := data[scanned]
+			if wlen == rollingWindowSize {
+				hash -= charOut[window[wpos]]
+			} else {
+				wlen++
+			}
+			hash = hash*rollingBase + uint64(b)
+			window[wpos] = b
+			wpos = (wpos + 1) % rollingWindowSize
+			chunkLen++
+
+			if chunkLen >= maxSize || (chunkLen >= minSize && hash&mask == mask) {
+				advance := scanned + 1
+				record := data[:advance]
+				scanned, chunkLen = 0, 0
+				return advance, record, nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			record := data
+			scanned, chunkLen = 0, 0
+			return len(record), record, nil
+		}
+		return 0, nil, nil
+	}
+}